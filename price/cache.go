@@ -1,19 +1,28 @@
 package price
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"sync"
+	"sync/atomic"
 	"time"
+
+	"golang.org/x/sync/errgroup"
 )
 
 // PriceService is a service that we can use to get prices for the items
-// Calls to this service are expensive (they take time)
+// Calls to this service are expensive (they take time). GetPriceFor should return promptly once ctx is
+// done, so a caller that gives up doesn't leave an expensive call running on its behalf.
 type PriceService interface {
-	GetPriceFor(itemCode string) (float64, error)
+	GetPriceFor(ctx context.Context, itemCode string) (float64, error)
 }
 
 type cachedPrice struct {
 	Price         float64
 	RetrievedTime time.Time
+	Err           error
+	IsNegative    bool
 }
 
 // TransparentCache is a cache that wraps the actual service
@@ -22,64 +31,338 @@ type cachedPrice struct {
 type TransparentCache struct {
 	actualPriceService PriceService
 	maxAge             time.Duration
-	prices             *ItemPriceMap
+	softMaxAge         time.Duration
+	store              Store
+	maxConcurrency     int
+	maxEntries         int
+	evictionInterval   time.Duration
+	onEvict            func(itemCode string, price float64)
+	negativeTTL        time.Duration
+	shouldCache        func(err error) bool
+	metrics            cacheMetrics
+
+	inFlightMutex sync.Mutex
+	inFlight      map[string]*inFlightCall
+}
+
+// Metrics is a snapshot of a TransparentCache's hit/miss/refresh counters, as returned by Stats.
+type Metrics struct {
+	Hits             uint64
+	SoftStaleHits    uint64
+	Misses           uint64
+	RefreshSuccesses uint64
+	RefreshFailures  uint64
+}
+
+// cacheMetrics holds the live, concurrently-updated counters backing Metrics
+type cacheMetrics struct {
+	hits             atomic.Uint64
+	softStaleHits    atomic.Uint64
+	misses           atomic.Uint64
+	refreshSuccesses atomic.Uint64
+	refreshFailures  atomic.Uint64
+}
+
+// inFlightCall represents an upstream call that is currently being made for an itemCode
+// Goroutines that find one already registered wait on it instead of issuing a call of their own
+type inFlightCall struct {
+	done  chan struct{}
+	price float64
+	err   error
+}
+
+// Option configures optional behavior of a TransparentCache
+type Option func(*TransparentCache)
+
+// WithMaxConcurrency caps the number of upstream PriceService calls GetPricesFor/GetPricesForContext
+// will have in flight at once. A value <= 0 (the default) leaves the number of calls unbounded.
+func WithMaxConcurrency(n int) Option {
+	return func(c *TransparentCache) {
+		c.maxConcurrency = n
+	}
+}
+
+// WithEvictionInterval starts a background janitor that proactively removes entries once they pass
+// maxAge, instead of only reporting them as misses on read. It wakes at most every d, sooner if the
+// earliest entry in the cache is due to expire before then. A value <= 0 (the default) disables it.
+func WithEvictionInterval(d time.Duration) Option {
+	return func(c *TransparentCache) {
+		c.evictionInterval = d
+	}
+}
+
+// WithMaxEntries caps the number of entries the cache holds at once; storing past the cap evicts the
+// least recently stored entry. A value <= 0 (the default) leaves the cache unbounded.
+func WithMaxEntries(n int) Option {
+	return func(c *TransparentCache) {
+		c.maxEntries = n
+	}
+}
+
+// WithOnEvict registers a callback invoked whenever an entry is proactively evicted, by either the
+// background janitor (see WithEvictionInterval) or the max-entries cap (see WithMaxEntries). It is
+// ignored when WithStore supplies a custom Store, since eviction policy then belongs to that Store.
+func WithOnEvict(fn func(itemCode string, price float64)) Option {
+	return func(c *TransparentCache) {
+		c.onEvict = fn
+	}
+}
+
+// WithStore replaces the cache's default InMemoryStore with s, e.g. a MemcachedStore so multiple
+// TransparentCache instances can share a cache tier. WithEvictionInterval, WithMaxEntries and
+// WithOnEvict configure the default InMemoryStore and have no effect once WithStore is used.
+func WithStore(s Store) Option {
+	return func(c *TransparentCache) {
+		c.store = s
+	}
 }
 
-func NewTransparentCache(actualPriceService PriceService, maxAge time.Duration) *TransparentCache {
-	return &TransparentCache{
+// WithSoftMaxAge enables stale-while-revalidate: once an entry's age passes d (but is still under the
+// hard maxAge), GetPriceFor returns the cached value immediately and triggers a background refresh, so
+// the next caller sees fresh data without anyone having to wait on the upstream call. A value <= 0 (the
+// default) disables this, so entries are served fresh until maxAge and block on a synchronous fetch
+// past it, as without this option.
+func WithSoftMaxAge(d time.Duration) Option {
+	return func(c *TransparentCache) {
+		c.softMaxAge = d
+	}
+}
+
+// WithNegativeTTL enables negative caching: when the upstream PriceService call fails with an error
+// ShouldCache (see WithShouldCache) accepts, that error is cached for d, so a subsequent GetPriceFor
+// within that window returns it immediately instead of hitting a broken upstream again. A value <= 0
+// (the default) disables this, so a failing call is retried on every subsequent GetPriceFor, as without
+// this option.
+func WithNegativeTTL(d time.Duration) Option {
+	return func(c *TransparentCache) {
+		c.negativeTTL = d
+	}
+}
+
+// WithShouldCache overrides which errors are eligible for negative caching (see WithNegativeTTL). The
+// default caches everything except context.Canceled and context.DeadlineExceeded, since those reflect
+// the caller giving up rather than the upstream actually failing.
+func WithShouldCache(fn func(err error) bool) Option {
+	return func(c *TransparentCache) {
+		c.shouldCache = fn
+	}
+}
+
+func defaultShouldCache(err error) bool {
+	return !errors.Is(err, context.Canceled) && !errors.Is(err, context.DeadlineExceeded)
+}
+
+func NewTransparentCache(actualPriceService PriceService, maxAge time.Duration, opts ...Option) *TransparentCache {
+	c := &TransparentCache{
 		actualPriceService: actualPriceService,
 		maxAge:             maxAge,
-		prices:             NewItemPricesMap(),
+		shouldCache:        defaultShouldCache,
+		inFlight:           make(map[string]*inFlightCall),
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	if c.store == nil {
+		c.store = NewInMemoryStore(maxAge, c.negativeTTL, c.maxEntries, c.evictionInterval, c.onEvict)
+	}
+	return c
+}
+
+// Close stops the cache's underlying Store, which for the default InMemoryStore means stopping the
+// background eviction janitor, if WithEvictionInterval was used. It is safe to call even when no
+// janitor was started.
+func (c *TransparentCache) Close() {
+	c.store.Close()
+}
+
+// Stats returns a snapshot of the cache's hit/miss/refresh counters
+func (c *TransparentCache) Stats() Metrics {
+	return Metrics{
+		Hits:             c.metrics.hits.Load(),
+		SoftStaleHits:    c.metrics.softStaleHits.Load(),
+		Misses:           c.metrics.misses.Load(),
+		RefreshSuccesses: c.metrics.refreshSuccesses.Load(),
+		RefreshFailures:  c.metrics.refreshFailures.Load(),
 	}
 }
 
 // GetPriceFor gets the price for the item, either from the cache or the actual service if it was not cached or too old
 func (c *TransparentCache) GetPriceFor(itemCode string) (float64, error) {
-	priceFromCache, ok := c.prices.Load(itemCode)
-	if ok {
-		if time.Since(priceFromCache.RetrievedTime) < c.maxAge {
+	return c.GetPriceForContext(context.Background(), itemCode)
+}
+
+// GetPriceForContext is GetPriceFor with cancellation: if ctx is done before a result is available, it
+// returns ctx.Err() instead of waiting. On a cache miss, ctx is also passed to
+// actualPriceService.GetPriceFor, so the upstream call itself can stop early, not just the caller waiting
+// on it (see fetchAndCache for the coalesced-call nuance). Concurrent misses for the same itemCode are
+// coalesced into a single upstream call, with every caller (and ctx) watching the same in-flight result.
+//
+// With WithSoftMaxAge set, an entry in the soft-stale window (older than softMaxAge but still under
+// maxAge) is returned immediately while a refresh is kicked off in the background; a cache miss (or an
+// entry past maxAge, since the Store no longer has it) still blocks on a synchronous fetch.
+//
+// With WithNegativeTTL set, a cached upstream error is returned immediately, the same as a fresh hit,
+// without re-triggering a background refresh.
+func (c *TransparentCache) GetPriceForContext(ctx context.Context, itemCode string) (float64, error) {
+	if priceFromCache, ok := c.store.Get(itemCode); ok {
+		if priceFromCache.IsNegative {
+			c.metrics.hits.Add(1)
+			return 0, priceFromCache.Err
+		}
+		if c.softMaxAge <= 0 || time.Since(priceFromCache.RetrievedTime) < c.softMaxAge {
+			c.metrics.hits.Add(1)
 			return priceFromCache.Price, nil
 		}
+		c.metrics.softStaleHits.Add(1)
+		go c.fetchAndCache(context.Background(), itemCode)
+		return priceFromCache.Price, nil
 	}
-	price, err := c.actualPriceService.GetPriceFor(itemCode)
-	if err != nil {
-		return 0, fmt.Errorf("getting price from service : %v", err.Error())
-	}
-	c.prices.Store(itemCode, cachedPrice{Price: price, RetrievedTime: time.Now()})
-	return price, nil
+
+	c.metrics.misses.Add(1)
+	return c.fetchAndCache(ctx, itemCode)
 }
 
-type channelResult struct {
-	Price    float64
-	Position int
+// fetchAndCache gets itemCode from the actual price service and stores the result, coalescing
+// concurrent calls for the same itemCode into a single upstream call via c.inFlight. The ctx passed to
+// actualPriceService.GetPriceFor is whichever caller's ctx started the in-flight call: if a later caller
+// joins an already in-flight call, only the original ctx can cancel the upstream call itself, not theirs
+// (they stop waiting on it regardless, same as always). If the original caller's ctx is cancelled, later
+// callers simply see that surface as an ordinary upstream error, the same as any other
+// actualPriceService failure.
+func (c *TransparentCache) fetchAndCache(ctx context.Context, itemCode string) (float64, error) {
+	c.inFlightMutex.Lock()
+	if call, ok := c.inFlight[itemCode]; ok {
+		c.inFlightMutex.Unlock()
+		select {
+		case <-call.done:
+			return call.price, call.err
+		case <-ctx.Done():
+			return 0, ctx.Err()
+		}
+	}
+	call := &inFlightCall{done: make(chan struct{})}
+	c.inFlight[itemCode] = call
+	c.inFlightMutex.Unlock()
+
+	go func() {
+		price, err := c.actualPriceService.GetPriceFor(ctx, itemCode)
+		if err != nil {
+			call.err = fmt.Errorf("getting price from service : %v", err.Error())
+			c.metrics.refreshFailures.Add(1)
+			// Only negative-cache when there's no still-valid positive entry to clobber: this call
+			// can be a background refresh of a merely soft-stale (not actually expired) entry (see
+			// GetPriceForContext), and a transient failure there shouldn't turn a servable price into
+			// a hard failure for everyone until negativeTTL expires.
+			if c.negativeTTL > 0 && c.shouldCache(err) {
+				if current, ok := c.store.Get(itemCode); !ok || current.IsNegative {
+					c.store.Set(itemCode, cachedPrice{Err: call.err, IsNegative: true, RetrievedTime: time.Now()})
+				}
+			}
+		} else {
+			call.price = price
+			c.store.Set(itemCode, cachedPrice{Price: price, RetrievedTime: time.Now()})
+			c.metrics.refreshSuccesses.Add(1)
+		}
+		c.inFlightMutex.Lock()
+		delete(c.inFlight, itemCode)
+		c.inFlightMutex.Unlock()
+		close(call.done)
+	}()
+
+	select {
+	case <-call.done:
+		return call.price, call.err
+	case <-ctx.Done():
+		return 0, ctx.Err()
+	}
 }
 
 // GetPricesFor gets the prices for several items at once, some might be found in the cache, others might not
 // If any of the operations returns an error, it should return an error as well
 func (c *TransparentCache) GetPricesFor(itemCodes ...string) ([]float64, error) {
+	return c.GetPricesForContext(context.Background(), itemCodes...)
+}
+
+// GetPricesForContext is GetPricesFor with cancellation and bounded parallelism: at most maxConcurrency
+// (see WithMaxConcurrency) upstream calls are in flight at once, and the first error cancels ctx so the
+// remaining goroutines stop waiting instead of leaking.
+func (c *TransparentCache) GetPricesForContext(ctx context.Context, itemCodes ...string) ([]float64, error) {
 	results := make([]float64, len(itemCodes))
-	resultChannel := make(chan channelResult)
-	errorChannel := make(chan error)
 
+	var sem chan struct{}
+	if c.maxConcurrency > 0 {
+		sem = make(chan struct{}, c.maxConcurrency)
+	}
+
+	g, ctx := errgroup.WithContext(ctx)
 	for i, itemCode := range itemCodes {
-		go func(itemCode string, position int) {
-			price, err := c.GetPriceFor(itemCode)
-			if err != nil {
-				errorChannel <- err
+		i, itemCode := i, itemCode
+		g.Go(func() error {
+			if sem != nil {
+				select {
+				case sem <- struct{}{}:
+					defer func() { <-sem }()
+				case <-ctx.Done():
+					return ctx.Err()
+				}
 			}
-			resultChannel <- channelResult{
-				Price:    price,
-				Position: position,
+			price, err := c.GetPriceForContext(ctx, itemCode)
+			if err != nil {
+				return err
 			}
-		}(itemCode, i)
+			results[i] = price
+			return nil
+		})
 	}
-	for range itemCodes {
-		select {
-		case result := <-resultChannel:
-			results[result.Position] = result.Price
-		case err := <-errorChannel:
-			return []float64{}, err
-		}
+	if err := g.Wait(); err != nil {
+		return []float64{}, err
 	}
 	return results, nil
 }
+
+// Result is the outcome of fetching a single item's price, as returned by GetPricesForPartial
+type Result struct {
+	Price float64
+	Err   error
+}
+
+// GetPricesForPartial gets the prices for several items at once, like GetPricesFor, but an error on one
+// item (commonly a cached negative, see WithNegativeTTL) does not prevent the others from being
+// returned: the outcome for each position is reported individually, analogous to memcache's per-key
+// error reporting on a multi-get.
+func (c *TransparentCache) GetPricesForPartial(itemCodes ...string) []Result {
+	return c.GetPricesForPartialContext(context.Background(), itemCodes...)
+}
+
+// GetPricesForPartialContext is GetPricesForPartial with cancellation and bounded parallelism (see
+// WithMaxConcurrency); a cancelled ctx is reported as the Err for any position still pending.
+func (c *TransparentCache) GetPricesForPartialContext(ctx context.Context, itemCodes ...string) []Result {
+	results := make([]Result, len(itemCodes))
+
+	var sem chan struct{}
+	if c.maxConcurrency > 0 {
+		sem = make(chan struct{}, c.maxConcurrency)
+	}
+
+	var wg sync.WaitGroup
+	for i, itemCode := range itemCodes {
+		i, itemCode := i, itemCode
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if sem != nil {
+				select {
+				case sem <- struct{}{}:
+					defer func() { <-sem }()
+				case <-ctx.Done():
+					results[i] = Result{Err: ctx.Err()}
+					return
+				}
+			}
+			price, err := c.GetPriceForContext(ctx, itemCode)
+			results[i] = Result{Price: price, Err: err}
+		}()
+	}
+	wg.Wait()
+	return results
+}
@@ -1,7 +1,9 @@
 package price
 
 import (
+	"context"
 	"fmt"
+	"runtime"
 	"sort"
 	"sync"
 	"testing"
@@ -15,18 +17,26 @@ type mockResult struct {
 }
 
 type mockPriceService struct {
-	numCalls    int
-	mutex       sync.Mutex
-	mockResults map[string]mockResult // what price and err to return for a particular itemCode
-	callDelay   time.Duration         // how long to sleep on each call so that we can simulate calls to be expensive
+	numCalls       int
+	mutex          sync.Mutex
+	mockResults    map[string]mockResult // what price and err to return for a particular itemCode
+	callDelay      time.Duration         // how long to sleep on each call so that we can simulate calls to be expensive
+	onCtxCancelled func()                // called if ctx is done before callDelay elapses, so tests can observe it
 }
 
-func (m *mockPriceService) GetPriceFor(itemCode string) (float64, error) {
+func (m *mockPriceService) GetPriceFor(ctx context.Context, itemCode string) (float64, error) {
 	m.mutex.Lock()
 	m.numCalls++ // increase the number of calls
 	m.mutex.Unlock()
 
-	time.Sleep(m.callDelay) // sleep to simulate expensive call
+	select {
+	case <-time.After(m.callDelay): // sleep to simulate expensive call
+	case <-ctx.Done():
+		if m.onCtxCancelled != nil {
+			m.onCtxCancelled()
+		}
+		return 0, ctx.Err()
+	}
 
 	result, ok := m.mockResults[itemCode]
 
@@ -37,6 +47,8 @@ func (m *mockPriceService) GetPriceFor(itemCode string) (float64, error) {
 }
 
 func (m *mockPriceService) getNumCalls() int {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
 	return m.numCalls
 }
 
@@ -158,6 +170,40 @@ func TestGetPriceFor_DoesNotReturnOldResults(t *testing.T) {
 	assertInt(t, 3, mockService.getNumCalls(), "wrong number of service calls")
 }
 
+// Check that concurrent misses for the same itemCode are coalesced into a single upstream call
+func TestGetPriceFor_CoalescesConcurrentMisses(t *testing.T) {
+	mockService := &mockPriceService{
+		callDelay: time.Millisecond * 200,
+		mockResults: map[string]mockResult{
+			"p1": {price: 5, err: nil},
+		},
+	}
+	cache := NewTransparentCache(mockService, time.Minute)
+
+	const numCallers = 10
+	var wg sync.WaitGroup
+	prices := make([]float64, numCallers)
+	errs := make([]error, numCallers)
+	for i := 0; i < numCallers; i++ {
+		wg.Add(1)
+		go func(position int) {
+			defer wg.Done()
+			prices[position], errs[position] = cache.GetPriceFor("p1")
+		}(i)
+	}
+	wg.Wait()
+
+	for i, err := range errs {
+		if err != nil {
+			t.Errorf("caller %v got unexpected error : %v", i, err)
+		}
+		if prices[i] != 5 {
+			t.Errorf("caller %v got wrong price : %v", i, prices[i])
+		}
+	}
+	assertInt(t, 1, mockService.getNumCalls(), "wrong number of service calls")
+}
+
 // Check that cache parallelize service calls when getting several values at once
 func TestGetPricesFor_ParallelizeCalls(t *testing.T) {
 	mockService := &mockPriceService{
@@ -183,3 +229,448 @@ func TestGetPricesFor_ParallelizeCalls(t *testing.T) {
 		t.Error("calls took too long, expected them to take a bit over one second")
 	}
 }
+
+// Check that GetPricesFor does not leak goroutines when one of the items errors
+func TestGetPricesFor_NoGoroutineLeakOnError(t *testing.T) {
+	mockService := &mockPriceService{
+		callDelay: time.Millisecond * 200,
+		mockResults: map[string]mockResult{
+			"p1": {price: 5, err: nil},
+			"p2": {price: 0, err: fmt.Errorf("some error")},
+			"p3": {price: 5, err: nil},
+			"p4": {price: 5, err: nil},
+			"p5": {price: 5, err: nil},
+		},
+	}
+	cache := NewTransparentCache(mockService, time.Minute)
+
+	before := runtime.NumGoroutine()
+	_, err := cache.GetPricesFor("p1", "p2", "p3", "p4", "p5")
+	if err == nil {
+		t.Fatal("expected an error, got nil")
+	}
+	// give any leaked goroutines a chance to show up before we count them
+	time.Sleep(time.Millisecond * 500)
+	after := runtime.NumGoroutine()
+	if after > before+1 {
+		t.Errorf("goroutines leaked : before %v, after %v", before, after)
+	}
+}
+
+// Check that GetPricesForContext respects the configured max concurrency
+func TestGetPricesForContext_RespectsMaxConcurrency(t *testing.T) {
+	var inFlight, maxInFlight int32
+	var mutex sync.Mutex
+	mockService := &countingPriceService{
+		onCall: func() {
+			mutex.Lock()
+			inFlight++
+			if inFlight > maxInFlight {
+				maxInFlight = inFlight
+			}
+			mutex.Unlock()
+			time.Sleep(time.Millisecond * 100)
+			mutex.Lock()
+			inFlight--
+			mutex.Unlock()
+		},
+		price: 5,
+	}
+	cache := NewTransparentCache(mockService, time.Minute, WithMaxConcurrency(2))
+
+	itemCodes := []string{"p1", "p2", "p3", "p4", "p5", "p6"}
+	_, err := cache.GetPricesForContext(context.Background(), itemCodes...)
+	if err != nil {
+		t.Fatalf("unexpected error : %v", err)
+	}
+	if maxInFlight > 2 {
+		t.Errorf("expected at most 2 concurrent upstream calls, got %v", maxInFlight)
+	}
+}
+
+// Check that cancelling the caller's context aborts pending fetches
+func TestGetPricesForContext_AbortsOnCancel(t *testing.T) {
+	mockService := &mockPriceService{
+		callDelay: time.Second,
+		mockResults: map[string]mockResult{
+			"p1": {price: 5, err: nil},
+			"p2": {price: 5, err: nil},
+		},
+	}
+	cache := NewTransparentCache(mockService, time.Minute)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*100)
+	defer cancel()
+
+	start := time.Now()
+	_, err := cache.GetPricesForContext(ctx, "p1", "p2")
+	elapsed := time.Since(start)
+
+	if err == nil {
+		t.Fatal("expected an error from the cancelled context, got nil")
+	}
+	if elapsed > (500 * time.Millisecond) {
+		t.Errorf("GetPricesForContext did not abort promptly on cancellation, took %v", elapsed)
+	}
+}
+
+// Check that cancelling the caller's context stops the upstream PriceService call itself, not just the
+// caller waiting on it
+func TestGetPriceForContext_CancelsUpstreamCall(t *testing.T) {
+	cancelled := make(chan struct{})
+	mockService := &mockPriceService{
+		callDelay: time.Second,
+		mockResults: map[string]mockResult{
+			"p1": {price: 5, err: nil},
+		},
+		onCtxCancelled: func() { close(cancelled) },
+	}
+	cache := NewTransparentCache(mockService, time.Minute)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*100)
+	defer cancel()
+
+	_, err := cache.GetPriceForContext(ctx, "p1")
+	if err == nil {
+		t.Fatal("expected an error from the cancelled context, got nil")
+	}
+
+	select {
+	case <-cancelled:
+	case <-time.After(time.Second):
+		t.Error("expected the upstream call to observe ctx cancellation, it kept running instead")
+	}
+}
+
+// countingPriceService is a PriceService whose every call is reported via onCall, used to track concurrency
+type countingPriceService struct {
+	onCall func()
+	price  float64
+}
+
+func (c *countingPriceService) GetPriceFor(ctx context.Context, itemCode string) (float64, error) {
+	c.onCall()
+	return c.price, nil
+}
+
+// Check that the background janitor evicts an entry shortly after maxAge, without any read triggering it
+func TestTransparentCache_JanitorEvictsExpiredEntries(t *testing.T) {
+	mockService := &mockPriceService{
+		mockResults: map[string]mockResult{
+			"p1": {price: 5, err: nil},
+		},
+	}
+	maxAge := time.Millisecond * 100
+	cache := NewTransparentCache(mockService, maxAge, WithEvictionInterval(time.Millisecond*20))
+	defer cache.Close()
+
+	getPriceWithNoErr(t, cache, "p1")
+	if _, ok := cache.store.Get("p1"); !ok {
+		t.Fatal("expected p1 to be cached right after the call")
+	}
+
+	time.Sleep(maxAge + time.Millisecond*200)
+
+	// Get already reports an expired entry as a miss, so look at the internal map to see the eviction
+	inMemory := cache.store.(*InMemoryStore)
+	inMemory.mutex.RLock()
+	_, ok := inMemory.internal["p1"]
+	inMemory.mutex.RUnlock()
+	if ok {
+		t.Error("expected the janitor to have evicted p1 after maxAge, without any read")
+	}
+}
+
+// Check that exceeding WithMaxEntries evicts the oldest entry and reports it through WithOnEvict
+func TestTransparentCache_MaxEntriesEvictsOldest(t *testing.T) {
+	var mutex sync.Mutex
+	var evicted []string
+	mockService := &mockPriceService{
+		mockResults: map[string]mockResult{
+			"p1": {price: 1},
+			"p2": {price: 2},
+			"p3": {price: 3},
+		},
+	}
+	cache := NewTransparentCache(mockService, time.Minute,
+		WithMaxEntries(2),
+		WithOnEvict(func(itemCode string, price float64) {
+			mutex.Lock()
+			evicted = append(evicted, itemCode)
+			mutex.Unlock()
+		}),
+	)
+	defer cache.Close()
+
+	getPriceWithNoErr(t, cache, "p1")
+	getPriceWithNoErr(t, cache, "p2")
+	getPriceWithNoErr(t, cache, "p3")
+
+	if _, ok := cache.store.Get("p1"); ok {
+		t.Error("expected p1 to have been evicted once the cache exceeded its max entries")
+	}
+	mutex.Lock()
+	defer mutex.Unlock()
+	if len(evicted) != 1 || evicted[0] != "p1" {
+		t.Errorf("expected p1 to be reported evicted, got %v", evicted)
+	}
+}
+
+// Check that onEvict can call back into the store (e.g. Get) without deadlocking, for an eviction
+// triggered by exceeding WithMaxEntries
+func TestTransparentCache_OnEvictCanCallBackIntoStore_MaxEntries(t *testing.T) {
+	mockService := &mockPriceService{
+		mockResults: map[string]mockResult{
+			"p1": {price: 1},
+			"p2": {price: 2},
+			"p3": {price: 3},
+		},
+	}
+	var cache *TransparentCache
+	cache = NewTransparentCache(mockService, time.Minute,
+		WithMaxEntries(2),
+		WithOnEvict(func(itemCode string, price float64) {
+			cache.store.Get("anything")
+		}),
+	)
+	defer cache.Close()
+
+	done := make(chan struct{})
+	go func() {
+		getPriceWithNoErr(t, cache, "p1")
+		getPriceWithNoErr(t, cache, "p2")
+		getPriceWithNoErr(t, cache, "p3")
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("onEvict calling back into the store deadlocked")
+	}
+}
+
+// Check that onEvict can call back into the store without deadlocking when the eviction is triggered by
+// the background janitor rather than a capacity-exceeding Set
+func TestTransparentCache_OnEvictCanCallBackIntoStore_Janitor(t *testing.T) {
+	mockService := &mockPriceService{
+		mockResults: map[string]mockResult{"p1": {price: 1}},
+	}
+	var cache *TransparentCache
+	cache = NewTransparentCache(mockService, time.Millisecond*50,
+		WithEvictionInterval(time.Millisecond*20),
+		WithOnEvict(func(itemCode string, price float64) {
+			cache.store.Get("anything")
+		}),
+	)
+	defer cache.Close()
+
+	getPriceWithNoErr(t, cache, "p1")
+
+	// poll the internal map rather than Get, which reports p1 as a miss once expired even before the
+	// janitor has evicted it
+	inMemory := cache.store.(*InMemoryStore)
+	done := make(chan struct{})
+	go func() {
+		for {
+			inMemory.mutex.RLock()
+			_, ok := inMemory.internal["p1"]
+			inMemory.mutex.RUnlock()
+			if !ok {
+				close(done)
+				return
+			}
+			time.Sleep(time.Millisecond * 5)
+		}
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("janitor-triggered onEvict deadlocked calling back into the store")
+	}
+}
+
+// Check that a request in the soft-stale window returns the old price instantly while a background
+// refresh calls the service again
+func TestGetPriceFor_ReturnsStaleAndRefreshesInBackground(t *testing.T) {
+	mockService := &mockPriceService{
+		callDelay: time.Millisecond * 300,
+		mockResults: map[string]mockResult{
+			"p1": {price: 5, err: nil},
+		},
+	}
+	softMaxAge := time.Millisecond * 100
+	maxAge := time.Millisecond * 500
+	cache := NewTransparentCache(mockService, maxAge, WithSoftMaxAge(softMaxAge))
+	defer cache.Close()
+
+	assertFloat(t, 5, getPriceWithNoErr(t, cache, "p1"), "wrong price returned")
+	assertInt(t, 1, mockService.getNumCalls(), "wrong number of service calls")
+
+	time.Sleep(softMaxAge + time.Millisecond*20) // now inside the soft-stale window
+
+	start := time.Now()
+	price := getPriceWithNoErr(t, cache, "p1")
+	elapsed := time.Since(start)
+	assertFloat(t, 5, price, "expected the stale price to still be returned")
+	if elapsed > time.Millisecond*100 {
+		t.Errorf("expected a soft-stale hit to return instantly, took %v", elapsed)
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for mockService.getNumCalls() < 2 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond * 20)
+	}
+	assertInt(t, 2, mockService.getNumCalls(), "expected the soft-stale hit to trigger a background refresh")
+
+	stats := cache.Stats()
+	if stats.SoftStaleHits != 1 {
+		t.Errorf("expected 1 soft-stale hit, got %v", stats.SoftStaleHits)
+	}
+}
+
+// Check that a request past the hard maxAge blocks on a synchronous fetch, unlike a soft-stale hit
+func TestGetPriceFor_BlocksSynchronouslyPastHardMaxAge(t *testing.T) {
+	mockService := &mockPriceService{
+		callDelay: time.Millisecond * 200,
+		mockResults: map[string]mockResult{
+			"p1": {price: 5, err: nil},
+		},
+	}
+	maxAge := time.Millisecond * 100
+	cache := NewTransparentCache(mockService, maxAge, WithSoftMaxAge(time.Millisecond*50))
+	defer cache.Close()
+
+	getPriceWithNoErr(t, cache, "p1")
+	time.Sleep(maxAge + time.Millisecond*50) // now past the hard maxAge
+
+	start := time.Now()
+	price := getPriceWithNoErr(t, cache, "p1")
+	elapsed := time.Since(start)
+	assertFloat(t, 5, price, "wrong price returned")
+	if elapsed < mockService.callDelay {
+		t.Errorf("expected the call past maxAge to block on a synchronous fetch, took only %v", elapsed)
+	}
+}
+
+// Check that a failed upstream call is negative-cached, so a subsequent call within the negative TTL
+// does not hit the service again
+func TestGetPriceFor_NegativeCachesFailures(t *testing.T) {
+	mockService := &mockPriceService{
+		mockResults: map[string]mockResult{
+			"p1": {price: 0, err: fmt.Errorf("some error")},
+		},
+	}
+	cache := NewTransparentCache(mockService, time.Minute, WithNegativeTTL(time.Millisecond*200))
+
+	_, err1 := cache.GetPriceFor("p1")
+	_, err2 := cache.GetPriceFor("p1")
+	if err1 == nil || err2 == nil {
+		t.Fatal("expected both calls to return an error")
+	}
+	if err1.Error() != err2.Error() {
+		t.Errorf("expected the same cached error on both calls, got %q and %q", err1, err2)
+	}
+	assertInt(t, 1, mockService.getNumCalls(), "expected the negative cache to absorb the second call")
+}
+
+// Check that a background refresh failure (triggered by a soft-stale hit) does not clobber a still
+// valid, within-hard-maxAge cached price with a negative entry
+func TestGetPriceFor_BackgroundRefreshFailureDoesNotClobberValidEntry(t *testing.T) {
+	mockService := &sequencedPriceService{
+		results: []mockResult{
+			{price: 5, err: nil},
+			{price: 0, err: fmt.Errorf("transient upstream error")},
+		},
+	}
+	softMaxAge := time.Millisecond * 50
+	maxAge := time.Second
+	cache := NewTransparentCache(mockService, maxAge, WithSoftMaxAge(softMaxAge), WithNegativeTTL(time.Minute))
+	defer cache.Close()
+
+	assertFloat(t, 5, getPriceWithNoErr(t, cache, "p1"), "wrong price returned")
+
+	time.Sleep(softMaxAge + time.Millisecond*20) // now inside the soft-stale window
+
+	price, err := cache.GetPriceFor("p1")
+	if err != nil {
+		t.Fatalf("unexpected error on soft-stale hit: %v", err)
+	}
+	assertFloat(t, 5, price, "expected the stale price to still be returned")
+
+	deadline := time.Now().Add(time.Second)
+	for mockService.callCount() < 2 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond * 20)
+	}
+	// give the failed background refresh a moment to (wrongly) write a negative entry, if it was going to
+	time.Sleep(time.Millisecond * 50)
+
+	price, err = cache.GetPriceFor("p1")
+	if err != nil {
+		t.Errorf("expected the still-valid cached price, got a negative-cached error instead: %v", err)
+	}
+	assertFloat(t, 5, price, "expected the original price to still be served")
+}
+
+// sequencedPriceService returns a different mockResult on each successive call (up to len(results)-1,
+// then repeats the last), used to simulate a background refresh failing after an earlier call succeeded
+type sequencedPriceService struct {
+	mutex   sync.Mutex
+	results []mockResult
+	calls   int
+}
+
+func (s *sequencedPriceService) GetPriceFor(ctx context.Context, itemCode string) (float64, error) {
+	s.mutex.Lock()
+	i := s.calls
+	if i >= len(s.results) {
+		i = len(s.results) - 1
+	}
+	s.calls++
+	s.mutex.Unlock()
+	result := s.results[i]
+	return result.price, result.err
+}
+
+func (s *sequencedPriceService) callCount() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.calls
+}
+
+// Check that the default ShouldCache classification opts context.Canceled out of negative caching
+func TestGetPriceFor_ShouldCacheCanSkipNegativeCaching(t *testing.T) {
+	mockService := &mockPriceService{
+		mockResults: map[string]mockResult{
+			"p1": {price: 0, err: context.Canceled},
+		},
+	}
+	cache := NewTransparentCache(mockService, time.Minute, WithNegativeTTL(time.Minute))
+
+	cache.GetPriceFor("p1")
+	cache.GetPriceFor("p1")
+	assertInt(t, 2, mockService.getNumCalls(), "expected context.Canceled to never be negative-cached")
+}
+
+// Check that GetPricesForPartial reports an upstream error for one item without failing the rest
+func TestGetPricesForPartial_IsolatesFailures(t *testing.T) {
+	mockService := &mockPriceService{
+		mockResults: map[string]mockResult{
+			"p1": {price: 5, err: nil},
+			"p2": {price: 0, err: fmt.Errorf("some error")},
+		},
+	}
+	cache := NewTransparentCache(mockService, time.Minute, WithNegativeTTL(time.Minute))
+
+	results := cache.GetPricesForPartial("p1", "p2")
+	if len(results) != 2 {
+		t.Fatalf("expected 2 results, got %v", len(results))
+	}
+	if results[0].Err != nil || results[0].Price != 5 {
+		t.Errorf("expected p1 to succeed with price 5, got %+v", results[0])
+	}
+	if results[1].Err == nil {
+		t.Errorf("expected p2 to report its error, got %+v", results[1])
+	}
+}
@@ -0,0 +1,247 @@
+package price
+
+import (
+	"container/heap"
+	"container/list"
+	"sync"
+	"time"
+)
+
+// InMemoryStore is the default Store: a map protected by a RWMutex, plus the bookkeeping needed to
+// proactively evict entries in the background rather than only on read.
+type InMemoryStore struct {
+	mutex       sync.RWMutex
+	internal    map[string]cachedPrice
+	maxAge      time.Duration
+	negativeTTL time.Duration
+
+	expiry expiryHeap
+
+	maxEntries int
+	lruOrder   *list.List
+	lruElems   map[string]*list.Element
+
+	onEvict func(itemCode string, price float64)
+
+	evictionInterval time.Duration
+	stopCh           chan struct{}
+	stopOnce         sync.Once
+}
+
+// expiryEntry is a single item in the expiry min-heap, ordered by expiresAt. retrievedTime identifies
+// which Set call produced it, so the janitor can tell a stale heap entry from a still-valid one without
+// having to remove the old entry from the heap when a key is refreshed.
+type expiryEntry struct {
+	itemCode      string
+	retrievedTime time.Time
+	expiresAt     time.Time
+	index         int
+}
+
+type expiryHeap []*expiryEntry
+
+func (h expiryHeap) Len() int           { return len(h) }
+func (h expiryHeap) Less(i, j int) bool { return h[i].expiresAt.Before(h[j].expiresAt) }
+func (h expiryHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *expiryHeap) Push(x any) {
+	entry := x.(*expiryEntry)
+	entry.index = len(*h)
+	*h = append(*h, entry)
+}
+
+func (h *expiryHeap) Pop() any {
+	old := *h
+	n := len(old)
+	entry := old[n-1]
+	old[n-1] = nil
+	*h = old[:n-1]
+	return entry
+}
+
+// NewInMemoryStore creates an InMemoryStore. maxAge is used to compute a positive entry's expiry from
+// its RetrievedTime, and negativeTTL a negative (IsNegative) entry's. maxEntries <= 0 leaves the store
+// unbounded, otherwise the least recently stored entry is evicted whenever a Set would exceed it.
+// evictionInterval <= 0 disables the background janitor; an expired entry is then reported as a miss by
+// Get but stays in the map until a later Set for its key replaces it or the maxEntries cap evicts it.
+// onEvict, if not nil, is called once eviction has been applied and s.mutex has been released, so it is
+// safe for onEvict to call back into the store (e.g. Get) without deadlocking, whenever an entry is
+// proactively evicted.
+func NewInMemoryStore(maxAge time.Duration, negativeTTL time.Duration, maxEntries int, evictionInterval time.Duration, onEvict func(itemCode string, price float64)) *InMemoryStore {
+	s := &InMemoryStore{
+		internal:         make(map[string]cachedPrice),
+		maxAge:           maxAge,
+		negativeTTL:      negativeTTL,
+		maxEntries:       maxEntries,
+		lruOrder:         list.New(),
+		lruElems:         make(map[string]*list.Element),
+		onEvict:          onEvict,
+		evictionInterval: evictionInterval,
+		stopCh:           make(chan struct{}),
+	}
+	if evictionInterval > 0 {
+		go s.runJanitor()
+	}
+	return s
+}
+
+// ttlFor returns how long value should live: negativeTTL for a negative entry, maxAge otherwise.
+func (s *InMemoryStore) ttlFor(value cachedPrice) time.Duration {
+	if value.IsNegative {
+		return s.negativeTTL
+	}
+	return s.maxAge
+}
+
+// Get returns the value stored under key, as long as it is not older than its ttl (see ttlFor). An
+// entry past its ttl is treated as a miss here even if the janitor hasn't swept it out yet.
+func (s *InMemoryStore) Get(key string) (cachedPrice, bool) {
+	s.mutex.RLock()
+	value, ok := s.internal[key]
+	s.mutex.RUnlock()
+	if !ok || time.Since(value.RetrievedTime) >= s.ttlFor(value) {
+		return cachedPrice{}, false
+	}
+	return value, true
+}
+
+func (s *InMemoryStore) Delete(key string) {
+	s.mutex.Lock()
+	s.deleteLocked(key)
+	s.mutex.Unlock()
+}
+
+// Set saves value under key, registering it with the background janitor (see NewInMemoryStore) using
+// value.RetrievedTime plus its ttl (see ttlFor) as its expiry, and touching the LRU order used for
+// maxEntries eviction. LRU position is only refreshed on writes, not reads, so a cache hit never needs
+// to take the write lock.
+func (s *InMemoryStore) Set(key string, value cachedPrice) {
+	s.mutex.Lock()
+	s.internal[key] = value
+	if s.evictionInterval > 0 {
+		// Nothing ever pops from s.expiry without a janitor running to do it, so only grow the
+		// heap when one is actually started; otherwise it would leak one entry per Set forever.
+		heap.Push(&s.expiry, &expiryEntry{itemCode: key, retrievedTime: value.RetrievedTime, expiresAt: value.RetrievedTime.Add(s.ttlFor(value))})
+	}
+	s.touchLRU(key)
+	evicted := s.evictOldestIfOverCapacityLocked()
+	s.mutex.Unlock()
+	s.notifyEvicted(evicted)
+}
+
+// Close stops the background janitor, if one was started. Safe to call even if no janitor is running,
+// and safe to call more than once.
+func (s *InMemoryStore) Close() {
+	s.stopOnce.Do(func() {
+		close(s.stopCh)
+	})
+}
+
+func (s *InMemoryStore) deleteLocked(key string) {
+	delete(s.internal, key)
+	if elem, ok := s.lruElems[key]; ok {
+		s.lruOrder.Remove(elem)
+		delete(s.lruElems, key)
+	}
+}
+
+func (s *InMemoryStore) touchLRU(key string) {
+	if elem, ok := s.lruElems[key]; ok {
+		s.lruOrder.MoveToBack(elem)
+		return
+	}
+	s.lruElems[key] = s.lruOrder.PushBack(key)
+}
+
+// evictedEntry identifies an entry that was just evicted, for reporting via onEvict once s.mutex is
+// no longer held.
+type evictedEntry struct {
+	itemCode string
+	price    float64
+}
+
+// notifyEvicted calls onEvict for each entry in evicted. Callers must not hold s.mutex, so that onEvict
+// can safely call back into the store.
+func (s *InMemoryStore) notifyEvicted(evicted []evictedEntry) {
+	if s.onEvict == nil {
+		return
+	}
+	for _, e := range evicted {
+		s.onEvict(e.itemCode, e.price)
+	}
+}
+
+func (s *InMemoryStore) evictOldestIfOverCapacityLocked() []evictedEntry {
+	if s.maxEntries <= 0 {
+		return nil
+	}
+	var evicted []evictedEntry
+	for len(s.internal) > s.maxEntries {
+		oldest := s.lruOrder.Front()
+		if oldest == nil {
+			return evicted
+		}
+		key := oldest.Value.(string)
+		price := s.internal[key].Price
+		s.deleteLocked(key)
+		evicted = append(evicted, evictedEntry{itemCode: key, price: price})
+	}
+	return evicted
+}
+
+func (s *InMemoryStore) runJanitor() {
+	timer := time.NewTimer(s.nextSleepDuration())
+	defer timer.Stop()
+	for {
+		select {
+		case <-s.stopCh:
+			return
+		case <-timer.C:
+			s.evictExpired(time.Now())
+			timer.Reset(s.nextSleepDuration())
+		}
+	}
+}
+
+// nextSleepDuration returns how long the janitor should sleep before its next sweep: until the earliest
+// entry in the expiry heap is due, capped at evictionInterval so an empty heap doesn't leave the
+// janitor sleeping forever and miss entries stored after it went to sleep.
+func (s *InMemoryStore) nextSleepDuration() time.Duration {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	if len(s.expiry) == 0 {
+		return s.evictionInterval
+	}
+	d := time.Until(s.expiry[0].expiresAt)
+	if d < 0 {
+		d = 0
+	}
+	if d > s.evictionInterval {
+		d = s.evictionInterval
+	}
+	return d
+}
+
+// evictExpired pops and deletes every heap entry that has passed its expiry as of now. An entry whose
+// key has since been refreshed by a later Set (so the map's RetrievedTime no longer matches the entry
+// the heap node was pushed for) is discarded without touching the map, since a fresher heap entry for
+// that key is already queued behind it.
+func (s *InMemoryStore) evictExpired(now time.Time) {
+	s.mutex.Lock()
+	var evicted []evictedEntry
+	for len(s.expiry) > 0 && !s.expiry[0].expiresAt.After(now) {
+		entry := heap.Pop(&s.expiry).(*expiryEntry)
+		current, ok := s.internal[entry.itemCode]
+		if !ok || !current.RetrievedTime.Equal(entry.retrievedTime) {
+			continue
+		}
+		s.deleteLocked(entry.itemCode)
+		evicted = append(evicted, evictedEntry{itemCode: entry.itemCode, price: current.Price})
+	}
+	s.mutex.Unlock()
+	s.notifyEvicted(evicted)
+}
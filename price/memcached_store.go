@@ -0,0 +1,104 @@
+package price
+
+import (
+	"bytes"
+	"encoding/gob"
+	"errors"
+	"time"
+
+	"github.com/bradfitz/gomemcache/memcache"
+)
+
+// memcacheClient is the subset of *memcache.Client MemcachedStore depends on, narrowed to an interface
+// so a fake in-process implementation can stand in for it in tests.
+type memcacheClient interface {
+	Get(key string) (*memcache.Item, error)
+	Set(item *memcache.Item) error
+	Delete(key string) error
+}
+
+// MemcachedStore is a Store backed by memcached, letting multiple TransparentCache instances share a
+// cache tier instead of each holding its own in-process map.
+type MemcachedStore struct {
+	client      memcacheClient
+	maxAge      time.Duration
+	negativeTTL time.Duration
+}
+
+// NewMemcachedStore wraps client (typically a *memcache.Client) as a Store. maxAge (or negativeTTL, for
+// a negative entry) is used to derive each item's memcached TTL as ttl - time.Since(value.RetrievedTime),
+// since memcached expires entries itself rather than relying on us to check RetrievedTime on read.
+func NewMemcachedStore(client memcacheClient, maxAge time.Duration, negativeTTL time.Duration) *MemcachedStore {
+	return &MemcachedStore{client: client, maxAge: maxAge, negativeTTL: negativeTTL}
+}
+
+// ttlFor returns how long value should live: negativeTTL for a negative entry, maxAge otherwise.
+func (s *MemcachedStore) ttlFor(value cachedPrice) time.Duration {
+	if value.IsNegative {
+		return s.negativeTTL
+	}
+	return s.maxAge
+}
+
+// wireCachedPrice is the gob-encodable shape of cachedPrice: the error interface itself isn't
+// gob-encodable, so a negative entry's error is round-tripped as a plain message.
+type wireCachedPrice struct {
+	Price         float64
+	RetrievedTime time.Time
+	IsNegative    bool
+	ErrMsg        string
+}
+
+func (s *MemcachedStore) Get(key string) (cachedPrice, bool) {
+	item, err := s.client.Get(key)
+	if err != nil {
+		return cachedPrice{}, false
+	}
+	var wire wireCachedPrice
+	if err := gob.NewDecoder(bytes.NewReader(item.Value)).Decode(&wire); err != nil {
+		return cachedPrice{}, false
+	}
+	value := cachedPrice{Price: wire.Price, RetrievedTime: wire.RetrievedTime, IsNegative: wire.IsNegative}
+	if wire.IsNegative {
+		value.Err = errors.New(wire.ErrMsg)
+	}
+	return value, true
+}
+
+func (s *MemcachedStore) Set(key string, value cachedPrice) {
+	ttl := s.ttlFor(value) - time.Since(value.RetrievedTime)
+	if ttl <= 0 {
+		return
+	}
+	wire := wireCachedPrice{Price: value.Price, RetrievedTime: value.RetrievedTime, IsNegative: value.IsNegative}
+	if value.Err != nil {
+		wire.ErrMsg = value.Err.Error()
+	}
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(wire); err != nil {
+		return
+	}
+	_ = s.client.Set(&memcache.Item{
+		Key:        key,
+		Value:      buf.Bytes(),
+		Expiration: secondsCeil(ttl),
+	})
+}
+
+// secondsCeil rounds d up to a whole number of seconds, with a floor of 1 for any d > 0. Truncating
+// instead (e.g. via ttl.Seconds()) would turn a sub-second ttl into memcache.Item.Expiration == 0, which
+// memcached treats as "never expires" rather than "already expired".
+func secondsCeil(d time.Duration) int32 {
+	secs := d / time.Second
+	if d%time.Second > 0 {
+		secs++
+	}
+	return int32(secs)
+}
+
+func (s *MemcachedStore) Delete(key string) {
+	_ = s.client.Delete(key)
+}
+
+// Close is a no-op: the memcache client's connection lifecycle is managed by its owner, not the Store.
+func (s *MemcachedStore) Close() {}
@@ -0,0 +1,78 @@
+package price
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bradfitz/gomemcache/memcache"
+)
+
+// fakeMemcacheClient is a minimal in-process stand-in for *memcache.Client, just enough to exercise
+// MemcachedStore without a real memcached server.
+type fakeMemcacheClient struct {
+	mutex             sync.Mutex
+	items             map[string]fakeMemcacheItem
+	lastSetExpiration int32
+}
+
+type fakeMemcacheItem struct {
+	value     []byte
+	expiresAt time.Time
+}
+
+func newFakeMemcacheClient() *fakeMemcacheClient {
+	return &fakeMemcacheClient{items: make(map[string]fakeMemcacheItem)}
+}
+
+func (f *fakeMemcacheClient) Get(key string) (*memcache.Item, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	item, ok := f.items[key]
+	if !ok || time.Now().After(item.expiresAt) {
+		return nil, memcache.ErrCacheMiss
+	}
+	return &memcache.Item{Key: key, Value: item.value}, nil
+}
+
+func (f *fakeMemcacheClient) Set(item *memcache.Item) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.lastSetExpiration = item.Expiration
+	f.items[item.Key] = fakeMemcacheItem{
+		value:     item.Value,
+		expiresAt: time.Now().Add(time.Duration(item.Expiration) * time.Second),
+	}
+	return nil
+}
+
+func (f *fakeMemcacheClient) lastExpiration() int32 {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.lastSetExpiration
+}
+
+func (f *fakeMemcacheClient) Delete(key string) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	delete(f.items, key)
+	return nil
+}
+
+// Check that a sub-second ttl (e.g. a maxAge or WithNegativeTTL configured in milliseconds) is rounded up
+// to at least one second rather than truncated to zero: memcache.Item.Expiration == 0 means "never
+// expires", so truncation would make the entry permanently cached instead of short-lived.
+func TestMemcachedStore_SubSecondTTLIsRoundedUpNotTruncatedToZero(t *testing.T) {
+	client := newFakeMemcacheClient()
+	store := NewMemcachedStore(client, time.Millisecond*200, 0)
+	defer store.Close()
+
+	store.Set("p1", cachedPrice{Price: 5, RetrievedTime: time.Now()})
+
+	if exp := client.lastExpiration(); exp < 1 {
+		t.Errorf("expected Expiration to be rounded up to at least 1s, got %v", exp)
+	}
+	if _, ok := store.Get("p1"); !ok {
+		t.Error("expected the entry to still be retrievable immediately after Set")
+	}
+}
@@ -0,0 +1,12 @@
+package price
+
+// Store is the cache backend a TransparentCache persists prices to. TransparentCache only ever talks
+// to this interface, so the default single-process InMemoryStore can be swapped for something like
+// MemcachedStore to share a cache tier across multiple service instances without changing
+// TransparentCache itself.
+type Store interface {
+	Get(key string) (cachedPrice, bool)
+	Set(key string, value cachedPrice)
+	Delete(key string)
+	Close()
+}
@@ -0,0 +1,95 @@
+package price
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Contract tests every Store implementation must pass: hit, miss, expiry and concurrent access.
+func TestStore_Contract(t *testing.T) {
+	newStores := map[string]func(maxAge time.Duration) Store{
+		"InMemoryStore": func(maxAge time.Duration) Store {
+			return NewInMemoryStore(maxAge, 0, 0, 0, nil)
+		},
+		"MemcachedStore": func(maxAge time.Duration) Store {
+			return NewMemcachedStore(newFakeMemcacheClient(), maxAge, 0)
+		},
+	}
+
+	for name, newStore := range newStores {
+		newStore := newStore
+		t.Run(name, func(t *testing.T) {
+			t.Run("miss", func(t *testing.T) {
+				store := newStore(time.Minute)
+				defer store.Close()
+				if _, ok := store.Get("missing"); ok {
+					t.Error("expected a miss for a key that was never set")
+				}
+			})
+
+			t.Run("hit", func(t *testing.T) {
+				store := newStore(time.Minute)
+				defer store.Close()
+				store.Set("p1", cachedPrice{Price: 5, RetrievedTime: time.Now()})
+				value, ok := store.Get("p1")
+				if !ok || value.Price != 5 {
+					t.Errorf("expected to get back the stored price, got %v (ok=%v)", value, ok)
+				}
+			})
+
+			t.Run("expiry", func(t *testing.T) {
+				// memcached TTLs are second-grained (and rounded up to whole seconds, see
+				// secondsCeil), so exercise expiry on a whole-second maxAge
+				maxAge := time.Second
+				store := newStore(maxAge)
+				defer store.Close()
+				store.Set("p1", cachedPrice{Price: 5, RetrievedTime: time.Now()})
+				time.Sleep(maxAge + time.Millisecond*500)
+				if _, ok := store.Get("p1"); ok {
+					t.Error("expected the entry to be gone once its TTL had passed")
+				}
+			})
+
+			t.Run("delete", func(t *testing.T) {
+				store := newStore(time.Minute)
+				defer store.Close()
+				store.Set("p1", cachedPrice{Price: 5, RetrievedTime: time.Now()})
+				store.Delete("p1")
+				if _, ok := store.Get("p1"); ok {
+					t.Error("expected the entry to be gone after Delete")
+				}
+			})
+
+			t.Run("repeated sets don't leak memory unboundedly", func(t *testing.T) {
+				store := newStore(time.Minute)
+				defer store.Close()
+				for i := 0; i < 500; i++ {
+					store.Set("p1", cachedPrice{Price: float64(i), RetrievedTime: time.Now()})
+				}
+				if s, ok := store.(*InMemoryStore); ok {
+					if len(s.expiry) > 1 {
+						t.Errorf("expected at most 1 expiry heap entry for a single repeatedly-set key with no janitor running, got %v", len(s.expiry))
+					}
+				}
+			})
+
+			t.Run("concurrent access", func(t *testing.T) {
+				store := newStore(time.Minute)
+				defer store.Close()
+				var wg sync.WaitGroup
+				for i := 0; i < 50; i++ {
+					wg.Add(1)
+					go func(i int) {
+						defer wg.Done()
+						key := fmt.Sprintf("p%v", i%5)
+						store.Set(key, cachedPrice{Price: float64(i), RetrievedTime: time.Now()})
+						store.Get(key)
+					}(i)
+				}
+				wg.Wait()
+			})
+		})
+	}
+}